@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	loader "github.com/abihf/cache-loader"
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// recheckInterval is how often a still-watched image gets rechecked against
+// the registry. It's jittered, and scheduled once per image rather than once
+// per pod, so that many pods sharing the same image don't all hit the
+// registry on their own independent timers.
+const recheckInterval = 15 * time.Minute
+
+// Work queue keys are plain strings disambiguated by prefix: a "pod:" item
+// reconciles a single pod, an "image:" item re-enqueues every pod currently
+// watching that image and reschedules itself.
+const (
+	podWorkPrefix   = "pod:"
+	imageWorkPrefix = "image:"
+)
+
+// Controller watches pods cluster-wide and periodically checks whether any
+// of their containers have a newer image available, per the policy resolved
+// by selectContainers. It also watches Secrets and ServiceAccounts so that
+// rotated pull credentials are picked up without waiting for the Repo's
+// cache TTLs to expire.
+type Controller struct {
+	clientset     kubernetes.Interface
+	repo          *Repo
+	strategy      restartStrategy
+	podLister     corelisters.PodLister
+	podsSynced    cache.InformerSynced
+	secretsSynced cache.InformerSynced
+	saSynced      cache.InformerSynced
+	queue         workqueue.RateLimitingInterface
+	watchers      *imageWatchers
+	restartMemory *loader.Loader[workloadKey, struct{}]
+}
+
+func NewController(clientset kubernetes.Interface, repo *Repo, informerFactory informers.SharedInformerFactory, strategy restartStrategy) *Controller {
+	podInformer := informerFactory.Core().V1().Pods()
+	secretInformer := informerFactory.Core().V1().Secrets()
+	saInformer := informerFactory.Core().V1().ServiceAccounts()
+
+	c := &Controller{
+		clientset:     clientset,
+		repo:          repo,
+		strategy:      strategy,
+		podLister:     podInformer.Lister(),
+		podsSynced:    podInformer.Informer().HasSynced,
+		secretsSynced: secretInformer.Informer().HasSynced,
+		saSynced:      saInformer.Informer().HasSynced,
+		queue:         workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		watchers:      newImageWatchers(),
+	}
+	c.restartMemory = loader.New(c.doRestartWorkload, restartCooldown)
+
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(_, newObj any) { c.enqueue(newObj) },
+		DeleteFunc: c.handlePodDelete,
+	})
+	secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, newObj any) { c.invalidateSecret(newObj) },
+		DeleteFunc: c.invalidateSecret,
+	})
+	saInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, newObj any) { c.invalidateServiceAccount(newObj) },
+		DeleteFunc: c.invalidateServiceAccount,
+	})
+
+	return c
+}
+
+func (c *Controller) enqueue(obj any) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.Add(podWorkPrefix + key)
+}
+
+func (c *Controller) handlePodDelete(obj any) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.watchers.removePod(key)
+}
+
+// invalidateSecret and invalidateServiceAccount drop the Repo's cached
+// credentials for the changed object, keyed the same way Repo's fetchers key
+// them ("namespace/name"), which cache.DeletionHandlingMetaNamespaceKeyFunc
+// already produces.
+func (c *Controller) invalidateSecret(obj any) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.repo.InvalidateSecret(key)
+}
+
+func (c *Controller) invalidateServiceAccount(obj any) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.repo.InvalidateServiceAccount(key)
+}
+
+// Run blocks processing the work queue with the given number of workers
+// until ctx is canceled.
+func (c *Controller) Run(ctx context.Context, workers int) {
+	defer c.queue.ShutDown()
+
+	if !cache.WaitForCacheSync(ctx.Done(), c.podsSynced, c.secretsSynced, c.saSynced) {
+		slog.Error("timed out waiting for informer caches to sync")
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	}
+	<-ctx.Done()
+}
+
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	if image, ok := strings.CutPrefix(key, imageWorkPrefix); ok {
+		c.recheckImage(item, image)
+		return true
+	}
+
+	podKey := strings.TrimPrefix(key, podWorkPrefix)
+	if err := c.reconcile(ctx, podKey); err != nil {
+		slog.Warn("failed to reconcile pod, retrying", "key", podKey, "error", err)
+		c.queue.AddRateLimited(item)
+		return true
+	}
+
+	c.queue.Forget(item)
+	return true
+}
+
+// recheckImage re-enqueues every pod currently watching image, then
+// reschedules itself after another jittered recheckInterval. This is the
+// only place a steady-state registry recheck gets scheduled from, so an
+// image shared by N pods is still only polled on one timer.
+func (c *Controller) recheckImage(item any, image string) {
+	for _, podKey := range c.watchers.podsFor(image) {
+		c.queue.Add(podWorkPrefix + podKey)
+	}
+	c.queue.Forget(item)
+	c.queue.AddAfter(item, jitter(recheckInterval))
+}
+
+func jitter(base time.Duration) time.Duration {
+	return base + time.Duration(rand.Int63n(int64(base)/2))
+}
+
+// imageWatchers tracks, for each image currently being checked, the set of
+// pod work-queue keys watching it. The first pod to watch an image schedules
+// that image's recheck timer; every later pod sharing the image just joins
+// the existing set instead of starting a timer of its own.
+type imageWatchers struct {
+	mu   sync.Mutex
+	pods map[string]map[string]struct{}
+}
+
+func newImageWatchers() *imageWatchers {
+	return &imageWatchers{pods: make(map[string]map[string]struct{})}
+}
+
+// add records that podKey watches image, and reports whether this is the
+// first watcher for image, in which case the caller should schedule its
+// recheck timer.
+func (w *imageWatchers) add(image, podKey string) (isFirst bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	set, ok := w.pods[image]
+	if !ok {
+		set = make(map[string]struct{})
+		w.pods[image] = set
+	}
+	set[podKey] = struct{}{}
+	return !ok
+}
+
+func (w *imageWatchers) podsFor(image string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	keys := make([]string, 0, len(w.pods[image]))
+	for podKey := range w.pods[image] {
+		keys = append(keys, podKey)
+	}
+	return keys
+}
+
+// removePod drops podKey from every image it was watching, e.g. once its pod
+// no longer exists.
+func (w *imageWatchers) removePod(podKey string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for image, set := range w.pods {
+		delete(set, podKey)
+		if len(set) == 0 {
+			delete(w.pods, image)
+		}
+	}
+}
+
+func (c *Controller) reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	pod, err := c.podLister.Pods(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		return nil
+	}
+	if len(pod.OwnerReferences) == 0 || !allowedOwnerKinds[pod.OwnerReferences[0].Kind] {
+		return nil
+	}
+
+	ownerAnnotations := getOwnerAnnotations(ctx, c.clientset, pod)
+	checks := selectContainers(pod, ownerAnnotations)
+	if len(checks) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() { checkDurationSeconds.Observe(time.Since(start).Seconds()) }()
+
+	needsUpdate := false
+	for _, status := range pod.Status.ContainerStatuses {
+		check, ok := checks[status.Name]
+		if !ok {
+			continue
+		}
+
+		imageRef := check.ref
+		if imageRef == "" {
+			imageRef = status.Image
+		}
+		registry := registryOf(imageRef)
+
+		if c.watchers.add(imageRef, key) {
+			c.queue.AddAfter(imageWorkPrefix+imageRef, jitter(recheckInterval))
+		}
+
+		currentHash := strings.Split(status.ImageID, ":")[1]
+		latestHash, err := c.repo.GetImageDigest(imageRef, pod.Namespace, pod.Spec.ServiceAccountName, pod.Spec.ImagePullSecrets, pod.Spec.NodeName)
+		if err != nil {
+			registryRequestsTotal.WithLabelValues(registry, "error").Inc()
+			slog.Warn("failed to get latest image hash for image", "image", imageRef, "error", err)
+			continue
+		}
+		registryRequestsTotal.WithLabelValues(registry, "ok").Inc()
+		if currentHash != latestHash {
+			needsUpdate = true
+		}
+	}
+
+	if !needsUpdate {
+		return nil
+	}
+	return c.triggerUpdate(ctx, pod)
+}
+
+func (c *Controller) triggerUpdate(ctx context.Context, pod *corev1.Pod) error {
+	if c.strategy == strategyRollout {
+		workload, err := c.resolveWorkload(ctx, pod)
+		if err != nil {
+			slog.Warn("failed to resolve owning workload, falling back to pod deletion", "namespace", pod.Namespace, "pod", pod.Name, "error", err)
+		} else if workload != nil {
+			return c.restartWorkload(ctx, *workload)
+		}
+	}
+	return c.deletePod(ctx, pod)
+}
+
+func (c *Controller) deletePod(ctx context.Context, pod *corev1.Pod) error {
+	if err := c.clientset.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("failed to delete pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+
+	ownerKind := ""
+	if len(pod.OwnerReferences) > 0 {
+		ownerKind = pod.OwnerReferences[0].Kind
+	}
+	podsRestartedTotal.WithLabelValues(pod.Namespace, ownerKind).Inc()
+	slog.Info("Deleted pod to force image pull", "namespace", pod.Namespace, "name", pod.Name)
+	return nil
+}
+
+func registryOf(image string) string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "unknown"
+	}
+	return ref.Context().RegistryStr()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"log/slog"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	registryRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "podrefresh_registry_requests_total",
+		Help: "Total number of registry digest lookups, by registry and result.",
+	}, []string{"registry", "result"})
+
+	podsRestartedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "podrefresh_pods_restarted_total",
+		Help: "Total number of restarts triggered to pick up a new image (one per deleted pod, or one per rolled-out workload), by namespace and owner kind.",
+	}, []string{"namespace", "owner_kind"})
+
+	checkDurationSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "podrefresh_check_duration_seconds",
+		Help: "Time spent checking a single pod's containers for newer images.",
+	})
+)
+
+// serveMetrics serves /metrics and /healthz until the process exits. It is
+// meant to run in its own goroutine; a failure to bind is fatal, since the
+// controller is unobservable without it.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	slog.Info("serving metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics server stopped", "error", err)
+		os.Exit(1)
+	}
+}
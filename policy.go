@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"log/slog"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// policyAnnotation selects the auto-update policy for every container in
+	// a pod. It may be overridden per-container with
+	// policyAnnotation + "." + <container-name>.
+	policyAnnotation       = "podrefresh.abihf.dev/policy"
+	policyAnnotationPrefix = policyAnnotation + "."
+
+	policyRegistry    = "registry"
+	policyDisabled    = "disabled"
+	policyImagePrefix = "image="
+)
+
+// containerCheck describes how a single container should be checked for a
+// newer image.
+type containerCheck struct {
+	// ref is the image reference whose digest is resolved and compared
+	// against the container's currently running image. Empty means use the
+	// container's own image, i.e. the "registry" policy.
+	ref string
+}
+
+// selectContainers inspects the pod (and its owner's) podrefresh.abihf.dev/policy
+// annotations and decides which containers should be checked for updates and
+// how. Containers with no applicable policy, or an explicit "disabled"
+// policy, are omitted from the result.
+func selectContainers(pod *corev1.Pod, ownerAnnotations map[string]string) map[string]containerCheck {
+	checks := make(map[string]containerCheck)
+	defaultPolicy := annotationValue(pod.Annotations, ownerAnnotations, policyAnnotation)
+
+	for _, container := range allContainers(pod) {
+		policy := annotationValue(pod.Annotations, ownerAnnotations, policyAnnotationPrefix+container.Name)
+		if policy == "" {
+			policy = defaultPolicy
+		}
+
+		switch {
+		case policy == "" || policy == policyDisabled:
+			continue
+		case policy == policyRegistry:
+			checks[container.Name] = containerCheck{}
+		case strings.HasPrefix(policy, policyImagePrefix):
+			checks[container.Name] = containerCheck{ref: strings.TrimPrefix(policy, policyImagePrefix)}
+		default:
+			slog.Warn("unknown podrefresh policy value", "policy", policy, "container", container.Name)
+		}
+	}
+	return checks
+}
+
+func allContainers(pod *corev1.Pod) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	containers = append(containers, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
+	return containers
+}
+
+func annotationValue(podAnnotations, ownerAnnotations map[string]string, key string) string {
+	if value, ok := podAnnotations[key]; ok {
+		return value
+	}
+	if value, ok := ownerAnnotations[key]; ok {
+		return value
+	}
+	return ""
+}
+
+// getOwnerAnnotations fetches the annotations of a pod's top-level owner so
+// that policy annotations can be set once on the Deployment/StatefulSet/
+// DaemonSet instead of on every pod. Errors are logged and treated as "no
+// annotations", since RBAC may legitimately prevent reading the owner; the
+// one exception is a failure to get a ReplicaSet's owning Deployment, which
+// falls back to the ReplicaSet's own annotations.
+func getOwnerAnnotations(ctx context.Context, clientset kubernetes.Interface, pod *corev1.Pod) map[string]string {
+	if len(pod.OwnerReferences) == 0 {
+		return nil
+	}
+	owner := pod.OwnerReferences[0]
+
+	var (
+		annotations map[string]string
+		err         error
+	)
+	switch owner.Kind {
+	case "ReplicaSet":
+		rs, getErr := clientset.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if getErr != nil {
+			err = getErr
+			break
+		}
+		annotations = rs.Annotations
+		// A Deployment-managed pod's policy annotation is set on the
+		// Deployment, not on the ReplicaSet it rolls out, so climb one more
+		// level, same as restart.go's resolveWorkload.
+		for _, rsOwner := range rs.OwnerReferences {
+			if rsOwner.Kind != "Deployment" {
+				continue
+			}
+			dep, depErr := clientset.AppsV1().Deployments(pod.Namespace).Get(ctx, rsOwner.Name, metav1.GetOptions{})
+			if depErr != nil {
+				slog.Warn("failed to get owning Deployment, falling back to ReplicaSet annotations", "namespace", pod.Namespace, "name", rsOwner.Name, "error", depErr)
+				break
+			}
+			annotations = dep.Annotations
+			break
+		}
+	case "StatefulSet":
+		sts, getErr := clientset.AppsV1().StatefulSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		err = getErr
+		if sts != nil {
+			annotations = sts.Annotations
+		}
+	case "DaemonSet":
+		ds, getErr := clientset.AppsV1().DaemonSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		err = getErr
+		if ds != nil {
+			annotations = ds.Annotations
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		slog.Warn("failed to get owner annotations", "kind", owner.Kind, "namespace", pod.Namespace, "name", owner.Name, "error", err)
+		return nil
+	}
+	return annotations
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func podWithContainers(annotations map[string]string, names ...string) *corev1.Pod {
+	containers := make([]corev1.Container, 0, len(names))
+	for _, name := range names {
+		containers = append(containers, corev1.Container{Name: name})
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+		Spec:       corev1.PodSpec{Containers: containers},
+	}
+}
+
+func TestSelectContainers(t *testing.T) {
+	tests := []struct {
+		name             string
+		pod              *corev1.Pod
+		ownerAnnotations map[string]string
+		want             map[string]containerCheck
+	}{
+		{
+			name: "no policy anywhere disables everything",
+			pod:  podWithContainers(nil, "app"),
+			want: map[string]containerCheck{},
+		},
+		{
+			name: "registry policy set on the pod itself",
+			pod:  podWithContainers(map[string]string{policyAnnotation: policyRegistry}, "app"),
+			want: map[string]containerCheck{"app": {}},
+		},
+		{
+			name:             "registry policy inherited from owner annotations (e.g. a StatefulSet)",
+			pod:              podWithContainers(nil, "app"),
+			ownerAnnotations: map[string]string{policyAnnotation: policyRegistry},
+			want:             map[string]containerCheck{"app": {}},
+		},
+		{
+			name: "explicit disabled policy wins over no policy",
+			pod:  podWithContainers(map[string]string{policyAnnotation: policyDisabled}, "app"),
+			want: map[string]containerCheck{},
+		},
+		{
+			name: "pinned image policy",
+			pod: podWithContainers(map[string]string{
+				policyAnnotation: policyImagePrefix + "example.com/app:pinned",
+			}, "app"),
+			want: map[string]containerCheck{"app": {ref: "example.com/app:pinned"}},
+		},
+		{
+			name: "per-container override wins over pod default (e.g. a DaemonSet sidecar)",
+			pod: podWithContainers(map[string]string{
+				policyAnnotation:                  policyRegistry,
+				policyAnnotationPrefix + "sidecar": policyDisabled,
+			}, "app", "sidecar"),
+			want: map[string]containerCheck{"app": {}},
+		},
+		{
+			name: "per-container override falls back to owner default",
+			pod: podWithContainers(map[string]string{
+				policyAnnotationPrefix + "sidecar": policyDisabled,
+			}, "app", "sidecar"),
+			ownerAnnotations: map[string]string{policyAnnotation: policyRegistry},
+			want:             map[string]containerCheck{"app": {}},
+		},
+		{
+			name: "unknown policy value is treated as no-op",
+			pod:  podWithContainers(map[string]string{policyAnnotation: "bogus"}, "app"),
+			want: map[string]containerCheck{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectContainers(tt.pod, tt.ownerAnnotations)
+			if len(got) != len(tt.want) {
+				t.Fatalf("selectContainers() = %#v, want %#v", got, tt.want)
+			}
+			for name, wantCheck := range tt.want {
+				gotCheck, ok := got[name]
+				if !ok {
+					t.Errorf("missing check for container %q", name)
+					continue
+				}
+				if gotCheck != wantCheck {
+					t.Errorf("check for container %q = %#v, want %#v", name, gotCheck, wantCheck)
+				}
+			}
+		})
+	}
+}
+
+func TestGetOwnerAnnotations(t *testing.T) {
+	const namespace = "default"
+
+	t.Run("StatefulSet owner", func(t *testing.T) {
+		sts := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "sts", Annotations: map[string]string{policyAnnotation: policyRegistry}},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "sts"}},
+			},
+		}
+		clientset := fake.NewSimpleClientset(sts)
+		got := getOwnerAnnotations(context.Background(), clientset, pod)
+		if got[policyAnnotation] != policyRegistry {
+			t.Fatalf("annotations = %#v, want policy annotation from StatefulSet", got)
+		}
+	})
+
+	t.Run("DaemonSet owner", func(t *testing.T) {
+		ds := &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "ds", Annotations: map[string]string{policyAnnotation: policyRegistry}},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "ds"}},
+			},
+		}
+		clientset := fake.NewSimpleClientset(ds)
+		got := getOwnerAnnotations(context.Background(), clientset, pod)
+		if got[policyAnnotation] != policyRegistry {
+			t.Fatalf("annotations = %#v, want policy annotation from DaemonSet", got)
+		}
+	})
+
+	t.Run("Deployment-owned pod climbs past its ReplicaSet", func(t *testing.T) {
+		dep := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "dep", Annotations: map[string]string{policyAnnotation: policyRegistry}},
+		}
+		rs := &appsv1.ReplicaSet{
+			// The controller-managed ReplicaSet carries no policy annotation
+			// of its own -- operators set it on the Deployment.
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				Name:            "dep-abc123",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "dep"}},
+			},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "dep-abc123"}},
+			},
+		}
+		clientset := fake.NewSimpleClientset(dep, rs)
+		got := getOwnerAnnotations(context.Background(), clientset, pod)
+		if got[policyAnnotation] != policyRegistry {
+			t.Fatalf("annotations = %#v, want policy annotation climbed from owning Deployment", got)
+		}
+	})
+
+	t.Run("bare ReplicaSet with no Deployment owner uses its own annotations", func(t *testing.T) {
+		rs := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "bare-rs", Annotations: map[string]string{policyAnnotation: policyRegistry}},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "bare-rs"}},
+			},
+		}
+		clientset := fake.NewSimpleClientset(rs)
+		got := getOwnerAnnotations(context.Background(), clientset, pod)
+		if got[policyAnnotation] != policyRegistry {
+			t.Fatalf("annotations = %#v, want policy annotation from bare ReplicaSet", got)
+		}
+	})
+}
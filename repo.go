@@ -2,54 +2,135 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"os/exec"
 	"strings"
 	"sync"
+	"time"
+
+	"log/slog"
 
 	loader "github.com/abihf/cache-loader"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	regv1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
-	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
 type PullSecretInfo struct {
-	namespace string
-	secrets   []corev1.LocalObjectReference
+	namespace          string
+	serviceAccountName string
+	secrets            []corev1.LocalObjectReference
 }
 
+// digestTTL bounds how long a resolved image digest is trusted before the
+// registry is hit again, so the controller keeps noticing newly pushed
+// images for as long as it runs rather than only on its first lookup.
+//
+// secretTTL and serviceAccountTTL bound the same staleness for pull
+// credentials; secretCache/saCache additionally let the controller purge an
+// entry the moment its Secret/ServiceAccount informer sees a change, so a
+// rotated credential doesn't have to wait out the TTL.
+const (
+	digestTTL         = 5 * time.Minute
+	secretTTL         = 10 * time.Minute
+	serviceAccountTTL = 10 * time.Minute
+)
+
 type Repo struct {
 	ctx           context.Context
 	clientset     *kubernetes.Clientset
 	pullSecrets   sync.Map
-	secretFetcher *loader.Loader[string, DockerAuths]
-	digestFetcher *loader.Loader[string, string]
+	secretCache   *invalidatableCache
+	saCache       *invalidatableCache
+	secretFetcher *loader.Loader[string, *parsedDockerConfig]
+	digestFetcher *loader.Loader[digestKey, string]
+	saFetcher     *loader.Loader[string, []corev1.LocalObjectReference]
+	nodeFetcher   *loader.Loader[string, regv1.Platform]
 }
 
 func NewRepo(clientset *kubernetes.Clientset) *Repo {
 	r := &Repo{
-		clientset: clientset,
+		clientset:   clientset,
+		secretCache: newInvalidatableCache(),
+		saCache:     newInvalidatableCache(),
 	}
-	r.secretFetcher = loader.New(r.fetchSecret, 0)
-	r.digestFetcher = loader.New(r.fetchDigest, 0)
+	r.secretFetcher = loader.New(r.fetchSecret, secretTTL, loader.WithDriver(r.secretCache))
+	r.digestFetcher = loader.New(r.fetchDigest, digestTTL)
+	r.saFetcher = loader.New(r.fetchServiceAccountSecrets, serviceAccountTTL, loader.WithDriver(r.saCache))
+	// Node platform doesn't change for the lifetime of a running node, so
+	// this one is fine to cache forever.
+	r.nodeFetcher = loader.New(r.fetchNodePlatform, 0)
 	return r
 }
 
-func (r *Repo) GetImageDigest(image string, namespace string, secrets []corev1.LocalObjectReference) (string, error) {
-	if len(secrets) > 0 {
+// invalidatableCache is a [loader.CacheDriver] that also allows purging a
+// single key, so callers that learn a cached value is stale (e.g. via a
+// Kubernetes informer) don't have to wait out the loader's TTL.
+type invalidatableCache struct {
+	sync.Map
+}
+
+func newInvalidatableCache() *invalidatableCache {
+	return &invalidatableCache{}
+}
+
+func (c *invalidatableCache) Add(key, value any)      { c.Store(key, value) }
+func (c *invalidatableCache) Get(key any) (any, bool) { return c.Load(key) }
+func (c *invalidatableCache) Invalidate(key any)      { c.Delete(key) }
+
+// InvalidateSecret drops any cached credentials parsed from the secret
+// identified by key (in "namespace/name" form), so a rotated
+// .dockerconfigjson takes effect on the next pull instead of after secretTTL.
+func (r *Repo) InvalidateSecret(key string) {
+	r.secretCache.Invalidate(key)
+}
+
+// InvalidateServiceAccount drops any cached imagePullSecrets resolved from
+// the ServiceAccount identified by key (in "namespace/name" form), so a
+// change to it takes effect on the next pull instead of after
+// serviceAccountTTL.
+func (r *Repo) InvalidateServiceAccount(key string) {
+	r.saCache.Invalidate(key)
+}
+
+// digestKey identifies a digest lookup by image reference and platform, so
+// that pods scheduled on nodes of different architectures don't share a
+// cached digest meant for a different manifest.
+type digestKey struct {
+	image        string
+	architecture string
+	os           string
+}
+
+var defaultPlatform = regv1.Platform{Architecture: "amd64", OS: "linux"}
+
+func (r *Repo) GetImageDigest(image string, namespace string, serviceAccountName string, secrets []corev1.LocalObjectReference, nodeName string) (string, error) {
+	if len(secrets) > 0 || serviceAccountName != "" {
 		key := getImageWithoutTag(image)
 		r.pullSecrets.Store(key, &PullSecretInfo{
-			namespace: namespace,
-			secrets:   secrets,
+			namespace:          namespace,
+			serviceAccountName: serviceAccountName,
+			secrets:            secrets,
 		})
 	}
-	digest, err := r.digestFetcher.Load(image)
+
+	platform := defaultPlatform
+	if nodeName != "" {
+		resolved, err := r.nodeFetcher.Load(nodeName)
+		if err != nil {
+			slog.Warn("failed to get node platform, falling back to linux/amd64", "node", nodeName, "error", err)
+		} else {
+			platform = resolved
+		}
+	}
+
+	digest, err := r.digestFetcher.Load(digestKey{image: image, architecture: platform.Architecture, os: platform.OS})
 	if err != nil {
 		return "", err
 	}
@@ -63,8 +144,8 @@ func getImageWithoutTag(image string) string {
 	return image
 }
 
-func (r *Repo) fetchDigest(ctx context.Context, image string) (string, error) {
-	ref, err := name.ParseReference(image)
+func (r *Repo) fetchDigest(ctx context.Context, key digestKey) (string, error) {
+	ref, err := name.ParseReference(key.image)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse image reference: %w", err)
 	}
@@ -74,8 +155,8 @@ func (r *Repo) fetchDigest(ctx context.Context, image string) (string, error) {
 		remote.WithContext(ctx),
 		remote.WithAuthFromKeychain(r),
 		remote.WithPlatform(regv1.Platform{
-			Architecture: "amd64",
-			OS:           "linux",
+			Architecture: key.architecture,
+			OS:           key.os,
 		}))
 	if err != nil {
 		return "", fmt.Errorf("failed to get image descriptor: %w", err)
@@ -92,43 +173,113 @@ func (r *Repo) Resolve(res authn.Resource) (authn.Authenticator, error) {
 	}
 	registry := res.RegistryStr()
 	pullSecretInfo := pullSecretIface.(*PullSecretInfo)
-	eg := errgroup.Group{}
-	for _, secretRef := range pullSecretInfo.secrets {
-		secretName := fmt.Sprintf("%s/%s", pullSecretInfo.namespace, secretRef.Name)
-		eg.Go(func() error {
-			auths, err := r.secretFetcher.Load(secretName)
-			if err != nil {
-				return err
-			}
-			if auth, ok := auths[registry]; ok {
-				return &foundSecret{auth: auth}
-			}
-			return nil
-		})
+
+	// pullSecretInfo is cached and Resolve can run concurrently for the same
+	// image (e.g. checked for two node platforms at once), so copy before
+	// appending instead of risking concurrent writes into pod.Spec.ImagePullSecrets'
+	// backing array.
+	secretRefs := append([]corev1.LocalObjectReference(nil), pullSecretInfo.secrets...)
+	if pullSecretInfo.serviceAccountName != "" {
+		saKey := fmt.Sprintf("%s/%s", pullSecretInfo.namespace, pullSecretInfo.serviceAccountName)
+		saSecrets, err := r.saFetcher.Load(saKey)
+		if err != nil {
+			slog.Warn("failed to get service account, falling back to pod imagePullSecrets", "namespace", pullSecretInfo.namespace, "name", pullSecretInfo.serviceAccountName, "error", err)
+		} else {
+			secretRefs = append(secretRefs, saSecrets...)
+		}
 	}
-	err := eg.Wait()
-	if err == nil {
+
+	return r.resolveFromSecrets(pullSecretInfo.namespace, registry, secretRefs)
+}
+
+// maxConcurrentSecretLookups bounds how many secrets are fetched at once
+// while resolving credentials for a single image.
+const maxConcurrentSecretLookups = 4
+
+// secretLookupResult is the outcome of checking a single imagePullSecret for
+// credentials matching a registry.
+type secretLookupResult struct {
+	auth *DockerAuth
+	err  error
+}
+
+// resolveFromSecrets checks each of secretRefs for credentials matching
+// registry. See firstMatchingSecret for the selection semantics.
+func (r *Repo) resolveFromSecrets(namespace, registry string, secretRefs []corev1.LocalObjectReference) (authn.Authenticator, error) {
+	return firstMatchingSecret(len(secretRefs), func(i int) secretLookupResult {
+		return r.lookupSecret(namespace, secretRefs[i].Name, registry)
+	})
+}
+
+// firstMatchingSecret runs lookup for each of the n secrets with bounded
+// concurrency, then returns the first *matching* credential in index order
+// -- the same order kubelet itself tries imagePullSecrets in -- rather than
+// whichever fetch happens to finish first. A secret that fails to fetch is
+// not silently treated as "no match": if nothing matches, the first fetch
+// error encountered is returned instead of falling back to anonymous, since
+// that would mask a real misconfiguration.
+func firstMatchingSecret(n int, lookup func(i int) secretLookupResult) (authn.Authenticator, error) {
+	if n == 0 {
 		return authn.Anonymous, nil
 	}
-	var found *foundSecret
-	if ok := errors.As(err, &found); ok {
-		return &authn.Basic{
-			Username: found.auth.Username,
-			Password: found.auth.Password,
-		}, nil
+
+	results := make([]secretLookupResult, n)
+	sem := make(chan struct{}, maxConcurrentSecretLookups)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i] = lookup(i)
+		}(i)
 	}
-	return nil, err
+	wg.Wait()
+
+	var firstErr error
+	for _, result := range results {
+		if result.auth != nil {
+			return result.auth.authenticator(), nil
+		}
+		if result.err != nil && firstErr == nil {
+			firstErr = result.err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return authn.Anonymous, nil
 }
 
-type foundSecret struct {
-	auth *DockerAuth
+func (r *Repo) lookupSecret(namespace, secretRefName, registry string) secretLookupResult {
+	secretName := fmt.Sprintf("%s/%s", namespace, secretRefName)
+	parsed, err := r.secretFetcher.Load(secretName)
+	if err != nil {
+		return secretLookupResult{err: err}
+	}
+	if auth, ok := parsed.auths[registry]; ok {
+		return secretLookupResult{auth: auth}
+	}
+	if parsed.credsStore != "" {
+		auth, err := runCredentialHelper(context.Background(), parsed.credsStore, registry)
+		if err != nil {
+			slog.Warn("failed to run credsStore helper", "helper", parsed.credsStore, "registry", registry, "error", err)
+		} else if auth != nil {
+			return secretLookupResult{auth: auth}
+		}
+	}
+	return secretLookupResult{}
 }
 
-func (*foundSecret) Error() string {
-	return "found secret"
+// parsedDockerConfig is the subset of a .dockerconfigjson secret that the
+// Repo cares about once it's been parsed and credHelpers have been resolved.
+type parsedDockerConfig struct {
+	auths      DockerAuths
+	credsStore string
 }
 
-func (r *Repo) fetchSecret(ctx context.Context, name string) (DockerAuths, error) {
+func (r *Repo) fetchSecret(ctx context.Context, name string) (*parsedDockerConfig, error) {
 	splitted := strings.SplitN(name, "/", 2)
 	namespace := splitted[0]
 	secretName := splitted[1]
@@ -148,18 +299,135 @@ func (r *Repo) fetchSecret(ctx context.Context, name string) (DockerAuths, error
 		return nil, fmt.Errorf("failed to parse docker config json from secret %s/%s: %w", namespace, secretName, err)
 	}
 
-	return config.Auths, nil
+	auths := config.Auths
+	if auths == nil {
+		auths = make(DockerAuths)
+	}
+	for registry, helper := range config.CredHelpers {
+		if _, ok := auths[registry]; ok {
+			continue
+		}
+		auth, err := runCredentialHelper(ctx, helper, registry)
+		if err != nil {
+			slog.Warn("failed to run credHelpers helper", "helper", helper, "registry", registry, "error", err)
+			continue
+		}
+		if auth != nil {
+			auths[registry] = auth
+		}
+	}
+
+	return &parsedDockerConfig{auths: auths, credsStore: config.CredsStore}, nil
+}
+
+// runCredentialHelper shells out to the docker-credential-<helper> binary on
+// PATH, following the protocol used by `docker-credential-*` helpers: the
+// registry is written to stdin of a "get" invocation, and a JSON object with
+// Username/Secret is read back from stdout. A Username of "<token>" means
+// Secret is an identity token rather than a password.
+func runCredentialHelper(ctx context.Context, helper string, registry string) (*DockerAuth, error) {
+	binary := "docker-credential-" + helper
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s not found on PATH: %w", binary, err)
+	}
+
+	cmd := exec.CommandContext(ctx, path, "get")
+	cmd.Stdin = strings.NewReader(registry)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s failed for %s: %w", binary, registry, err)
+	}
+
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse output of credential helper %s: %w", binary, err)
+	}
+	if resp.Username == "<token>" {
+		return &DockerAuth{IdentityToken: resp.Secret}, nil
+	}
+	return &DockerAuth{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// fetchNodePlatform reads the architecture/OS the kubelet actually reported
+// for a node, so digests are resolved for the manifest that was really
+// pulled instead of assuming linux/amd64.
+func (r *Repo) fetchNodePlatform(ctx context.Context, nodeName string) (regv1.Platform, error) {
+	node, err := r.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return regv1.Platform{}, err
+	}
+	return regv1.Platform{
+		Architecture: node.Status.NodeInfo.Architecture,
+		OS:           node.Status.NodeInfo.OperatingSystem,
+	}, nil
+}
+
+func (r *Repo) fetchServiceAccountSecrets(ctx context.Context, name string) ([]corev1.LocalObjectReference, error) {
+	splitted := strings.SplitN(name, "/", 2)
+	namespace := splitted[0]
+	saName := splitted[1]
+
+	sa, err := r.clientset.CoreV1().ServiceAccounts(namespace).Get(ctx, saName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return sa.ImagePullSecrets, nil
 }
 
 type DockerAuth struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+	Email         string `json:"email"`
+}
+
+// authenticator turns a parsed auth entry into the credential type
+// go-containerregistry expects, preferring tokens (used by ECR/GCR/ACR/Harbor
+// OIDC flows) over a username/password pair.
+func (a *DockerAuth) authenticator() authn.Authenticator {
+	switch {
+	case a.IdentityToken != "":
+		return &authn.Bearer{Token: a.IdentityToken}
+	case a.RegistryToken != "":
+		return &authn.Bearer{Token: a.RegistryToken}
+	default:
+		return &authn.Basic{Username: a.Username, Password: a.Password}
+	}
 }
 
 type DockerAuths map[string]*DockerAuth
 
+// UnmarshalJSON decodes a base64 `auth: "user:pass"` field into
+// Username/Password when they aren't already set directly.
+func (a *DockerAuth) UnmarshalJSON(data []byte) error {
+	type plain DockerAuth
+	var p plain
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	*a = DockerAuth(p)
+	if a.Auth != "" && a.Username == "" && a.Password == "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err == nil {
+			if user, pass, ok := strings.Cut(string(decoded), ":"); ok {
+				a.Username = user
+				a.Password = pass
+			}
+		}
+	}
+	return nil
+}
+
 type DockerConfig struct {
-	Auths DockerAuths `json:"auths"`
+	Auths       DockerAuths       `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
 }
 
 func parseDockerConfigJson(data []byte) (*DockerConfig, error) {
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+func TestParseDockerConfigJson(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		registry string
+		want     DockerAuth
+	}{
+		{
+			name:     "plain username and password",
+			data:     `{"auths":{"registry.example.com":{"username":"u","password":"p"}}}`,
+			registry: "registry.example.com",
+			want:     DockerAuth{Username: "u", Password: "p"},
+		},
+		{
+			name:     "base64 auth field",
+			data:     `{"auths":{"registry.example.com":{"auth":"dTpw"}}}`,
+			registry: "registry.example.com",
+			want:     DockerAuth{Auth: "dTpw", Username: "u", Password: "p"},
+		},
+		{
+			name:     "identitytoken field",
+			data:     `{"auths":{"registry.example.com":{"identitytoken":"tok"}}}`,
+			registry: "registry.example.com",
+			want:     DockerAuth{IdentityToken: "tok"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseDockerConfigJson([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("parseDockerConfigJson() error = %v", err)
+			}
+			got, ok := config.Auths[tt.registry]
+			if !ok {
+				t.Fatalf("missing auth entry for %q", tt.registry)
+			}
+			if *got != tt.want {
+				t.Errorf("got = %#v, want %#v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerAuthAuthenticator(t *testing.T) {
+	if auth := (&DockerAuth{IdentityToken: "tok"}).authenticator(); auth == nil {
+		t.Fatal("expected non-nil authenticator for identity token")
+	}
+	if auth := (&DockerAuth{Username: "u", Password: "p"}).authenticator(); auth == nil {
+		t.Fatal("expected non-nil authenticator for basic auth")
+	}
+}
+
+func TestFirstMatchingSecret(t *testing.T) {
+	errFetch := errors.New("failed to fetch secret")
+
+	tests := []struct {
+		name     string
+		results  []secretLookupResult
+		wantUser string
+		wantErr  error
+		wantAnon bool
+	}{
+		{
+			name:     "no secrets",
+			results:  nil,
+			wantAnon: true,
+		},
+		{
+			name:     "one matching secret",
+			results:  []secretLookupResult{{auth: &DockerAuth{Username: "only"}}},
+			wantUser: "only",
+		},
+		{
+			name: "multiple matching secrets, first wins",
+			results: []secretLookupResult{
+				{auth: &DockerAuth{Username: "first"}},
+				{auth: &DockerAuth{Username: "second"}},
+			},
+			wantUser: "first",
+		},
+		{
+			name: "one erroring then one matching, match wins over the earlier error",
+			results: []secretLookupResult{
+				{err: errFetch},
+				{auth: &DockerAuth{Username: "good"}},
+			},
+			wantUser: "good",
+		},
+		{
+			name: "all erroring surfaces the first error instead of anonymous",
+			results: []secretLookupResult{
+				{err: errFetch},
+				{err: errors.New("a different failure")},
+			},
+			wantErr: errFetch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth, err := firstMatchingSecret(len(tt.results), func(i int) secretLookupResult {
+				return tt.results[i]
+			})
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantAnon {
+				if auth != authn.Anonymous {
+					t.Fatalf("auth = %v, want authn.Anonymous", auth)
+				}
+				return
+			}
+			basic, ok := auth.(*authn.Basic)
+			if !ok {
+				t.Fatalf("auth = %#v, want *authn.Basic", auth)
+			}
+			if basic.Username != tt.wantUser {
+				t.Errorf("Username = %q, want %q", basic.Username, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"log/slog"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// restartStrategy controls how a pod with a newer image is refreshed.
+type restartStrategy string
+
+const (
+	// strategyRollout patches the owning workload's pod template, letting
+	// the workload controller roll it out according to its own update
+	// strategy and any PodDisruptionBudget.
+	strategyRollout restartStrategy = "rollout"
+	// strategyDelete deletes the pod directly, same as podrefresh's
+	// original behavior.
+	strategyDelete restartStrategy = "delete"
+)
+
+// restartCooldown de-duplicates rollout restarts: several pods belonging to
+// the same workload can be found to need an update within moments of each
+// other, but the workload should only be patched once.
+const restartCooldown = 30 * time.Second
+
+// workloadKey identifies the top-level workload owning a pod.
+type workloadKey struct {
+	namespace string
+	kind      string
+	name      string
+}
+
+// resolveWorkload walks a pod's owner reference up to the top-level workload
+// that manages its template: a ReplicaSet's owning Deployment, or a
+// StatefulSet/DaemonSet directly. It returns nil if the pod has no
+// manageable owner -- including a bare ReplicaSet with no Deployment above
+// it, since a ReplicaSet controller only reconciles replica count and has no
+// rolling-update logic to pick up a patched template -- in which case the
+// caller should fall back to deleting the pod.
+func (c *Controller) resolveWorkload(ctx context.Context, pod *corev1.Pod) (*workloadKey, error) {
+	if len(pod.OwnerReferences) == 0 {
+		return nil, nil
+	}
+	owner := pod.OwnerReferences[0]
+
+	switch owner.Kind {
+	case "StatefulSet", "DaemonSet":
+		return &workloadKey{namespace: pod.Namespace, kind: owner.Kind, name: owner.Name}, nil
+	case "ReplicaSet":
+		rs, err := c.clientset.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get owner ReplicaSet %s/%s: %w", pod.Namespace, owner.Name, err)
+		}
+		for _, rsOwner := range rs.OwnerReferences {
+			if rsOwner.Kind == "Deployment" {
+				return &workloadKey{namespace: pod.Namespace, kind: "Deployment", name: rsOwner.Name}, nil
+			}
+		}
+		return nil, nil
+	default:
+		return nil, nil
+	}
+}
+
+// restartWorkload triggers a rollout restart of the given workload, same as
+// `kubectl rollout restart`, de-duplicated by restartCooldown so that
+// multiple pods of the same workload only trigger a single patch.
+func (c *Controller) restartWorkload(ctx context.Context, workload workloadKey) error {
+	_, err := c.restartMemory.Load(workload)
+	return err
+}
+
+func (c *Controller) doRestartWorkload(ctx context.Context, workload workloadKey) (struct{}, error) {
+	patch := fmt.Sprintf(
+		`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":%q}}}}}`,
+		time.Now().Format(time.RFC3339),
+	)
+
+	var err error
+	switch workload.kind {
+	case "Deployment":
+		_, err = c.clientset.AppsV1().Deployments(workload.namespace).
+			Patch(ctx, workload.name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = c.clientset.AppsV1().StatefulSets(workload.namespace).
+			Patch(ctx, workload.name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	case "DaemonSet":
+		_, err = c.clientset.AppsV1().DaemonSets(workload.namespace).
+			Patch(ctx, workload.name, types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	default:
+		return struct{}{}, fmt.Errorf("unsupported workload kind %q for rollout restart", workload.kind)
+	}
+	if err != nil {
+		return struct{}{}, fmt.Errorf("failed to patch %s %s/%s: %w", workload.kind, workload.namespace, workload.name, err)
+	}
+
+	podsRestartedTotal.WithLabelValues(workload.namespace, workload.kind).Inc()
+	slog.Info("triggered rolling restart", "namespace", workload.namespace, "kind", workload.kind, "name", workload.name)
+	return struct{}{}, nil
+}
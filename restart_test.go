@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolveWorkload(t *testing.T) {
+	const namespace = "default"
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		objects []runtime.Object
+		want    *workloadKey
+	}{
+		{
+			name: "no owner",
+			pod:  &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace}},
+			want: nil,
+		},
+		{
+			name: "StatefulSet owner",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: "sts"}},
+			}},
+			want: &workloadKey{namespace: namespace, kind: "StatefulSet", name: "sts"},
+		},
+		{
+			name: "DaemonSet owner",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "ds"}},
+			}},
+			want: &workloadKey{namespace: namespace, kind: "DaemonSet", name: "ds"},
+		},
+		{
+			name: "ReplicaSet owned by a Deployment resolves to the Deployment",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "dep-abc123"}},
+			}},
+			objects: []runtime.Object{&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				Name:            "dep-abc123",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "dep"}},
+			}}},
+			want: &workloadKey{namespace: namespace, kind: "Deployment", name: "dep"},
+		},
+		{
+			// A bare ReplicaSet has no rolling-update logic of its own, so
+			// patching its template would never recreate the running pod --
+			// this must fall back to pod deletion instead (nil, nil).
+			name: "bare ReplicaSet with no Deployment owner has no manageable workload",
+			pod: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Namespace:       namespace,
+				OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "bare-rs"}},
+			}},
+			objects: []runtime.Object{&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      "bare-rs",
+			}}},
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Controller{clientset: fake.NewSimpleClientset(tt.objects...)}
+
+			got, err := c.resolveWorkload(context.Background(), tt.pod)
+			if err != nil {
+				t.Fatalf("resolveWorkload() error = %v", err)
+			}
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("resolveWorkload() = %#v, want %#v", got, tt.want)
+			}
+			if got != nil && *got != *tt.want {
+				t.Fatalf("resolveWorkload() = %#v, want %#v", *got, *tt.want)
+			}
+		})
+	}
+}